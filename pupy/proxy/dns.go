@@ -1,15 +1,345 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	dns "github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 )
 
+// sdListenFdsStart is SD_LISTEN_FDS_START: systemd hands activated sockets
+// to the process starting at this descriptor.
+const sdListenFdsStart = 3
+
+// pendingTimeout is how long a question waits for a backend response before
+// it becomes eligible for reclaiming; the janitor reclaims it on its first
+// sweep after that.
+const pendingTimeout = 30 * time.Second
+
+// pendingSweepInterval is how often the janitor walks the pending map for
+// expired requests.
+const pendingSweepInterval = 1 * time.Minute
+
+// cacheSweepInterval is how often the janitor walks the DNS cache for
+// expired records.
+const cacheSweepInterval = 1 * time.Minute
+
+// pendingRequest tracks a question that has been sent to the backend but not
+// yet answered, so messageReader can demultiplex the matching response back
+// to the caller blocked on response.
+type pendingRequest struct {
+	expire   time.Time
+	response chan []DNSAnswer
+}
+
+// DNSAnswer is one backend-resolved value together with the TTL the backend
+// wants it served and cached with.
+type DNSAnswer struct {
+	Value string
+	TTL   uint32
+}
+
+// DNSCacheRecord holds the answers served for a single question, along with
+// the bookkeeping needed to expire it.
+type DNSCacheRecord struct {
+	ResponseRecords []dns.RR
+	Expire          time.Time
+}
+
+// dnsCacheKey identifies a cached answer. Keying on Qtype too keeps an A
+// lookup from poisoning the cache entry an AAAA lookup for the same name
+// would use.
+type dnsCacheKey struct {
+	Name  string
+	Qtype uint16
+}
+
+// DNSRequest is a single outstanding lookup handed off to the backend over
+// p.Conn.
+type DNSRequest struct {
+	Name    string
+	Qtype   uint16
+	Answers chan []DNSAnswer
+}
+
+// DNSListener bridges the miekg/dns UDP/TCP servers to the backend connection
+// used to resolve names under Domain.
+type DNSListener struct {
+	Conn   net.Conn
+	Domain string
+
+	DNSCache     map[dnsCacheKey]*DNSCacheRecord
+	DNSCacheLock sync.RWMutex
+
+	UDPServer *dns.Server
+	TCPServer *dns.Server
+
+	// TLSServer and DoHServer are optional DoT/DoH sibling listeners, left
+	// nil unless enabled via config.
+	TLSServer *dns.Server
+	DoHServer *http.Server
+
+	DNSRequests chan *DNSRequest
+
+	// pending holds in-flight backend requests keyed by transaction id, so
+	// responses can come back out of order without serializing queries on a
+	// single in-flight RTT.
+	pending     map[uint32]*pendingRequest
+	pendingLock sync.Mutex
+	pendingNext uint32
+
+	// stopJanitors is closed on Shutdown to tear down the pending-request
+	// and DNS-cache reaper goroutines.
+	stopJanitors chan struct{}
+
+	// SOA fields used to build the authority record attached to negative
+	// responses, so resolvers can negatively cache them.
+	SOAMname   string
+	SOARname   string
+	SOASerial  uint32
+	SOARefresh uint32
+	SOARetry   uint32
+	SOAExpire  uint32
+	SOAMinttl  uint32
+
+	active     bool
+	activeLock sync.Mutex
+}
+
+// soaRecord builds the SOA record for p.Domain, attached to negative
+// responses (NXDOMAIN and empty NOERROR) so resolvers can drive their
+// negative-caching TTL off it instead of retrying immediately.
+func (p *DNSListener) soaRecord() *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(p.Domain),
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    p.SOAMinttl,
+		},
+		Ns:      dns.Fqdn(p.SOAMname),
+		Mbox:    dns.Fqdn(p.SOARname),
+		Serial:  p.SOASerial,
+		Refresh: p.SOARefresh,
+		Retry:   p.SOARetry,
+		Expire:  p.SOAExpire,
+		Minttl:  p.SOAMinttl,
+	}
+}
+
+// supportedQtype reports whether qtype is one we know how to resolve
+// against the backend and answer from the cache.
+func supportedQtype(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeTXT, dns.TypeSRV:
+		return true
+	default:
+		return false
+	}
+}
+
+// newRR turns one backend response value for name/qtype into the matching
+// dns.RR, served with ttl.
+func newRR(name string, qtype uint16, value string, ttl uint32) (dns.RR, error) {
+	hdr := dns.RR_Header{
+		Name:   name,
+		Rrtype: qtype,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+
+	switch qtype {
+	case dns.TypeA:
+		ip := net.ParseIP(value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("dns: %q is not an IPv4 address", value)
+		}
+
+		return &dns.A{Hdr: hdr, A: ip}, nil
+
+	case dns.TypeAAAA:
+		ip := net.ParseIP(value).To16()
+		if ip == nil {
+			return nil, fmt.Errorf("dns: %q is not an IPv6 address", value)
+		}
+
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}, nil
+
+	case dns.TypeCNAME:
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(value)}, nil
+
+	case dns.TypeTXT:
+		return &dns.TXT{Hdr: hdr, Txt: splitTXT(value)}, nil
+
+	case dns.TypeSRV:
+		var prio, weight, port uint16
+
+		var target string
+
+		if _, err := fmt.Sscanf(value, "%d %d %d %s", &prio, &weight, &port, &target); err != nil {
+			return nil, fmt.Errorf("dns: malformed SRV value %q: %w", value, err)
+		}
+
+		return &dns.SRV{Hdr: hdr, Priority: prio, Weight: weight, Port: port, Target: dns.Fqdn(target)}, nil
+
+	default:
+		return nil, fmt.Errorf("dns: unsupported query type %d", qtype)
+	}
+}
+
+// splitTXT breaks value into the 255-byte character-strings a TXT record's
+// RDATA is made of.
+func splitTXT(value string) []string {
+	const maxChunk = 255
+
+	if value == "" {
+		return []string{""}
+	}
+
+	chunks := make([]string, 0, (len(value)+maxChunk-1)/maxChunk)
+	for len(value) > maxChunk {
+		chunks = append(chunks, value[:maxChunk])
+		value = value[maxChunk:]
+	}
+
+	return append(chunks, value)
+}
+
+// register allocates a transaction id for response and stores it in the
+// pending map so messageReader can find it when the backend answers.
+func (p *DNSListener) register(response chan []DNSAnswer) uint32 {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+
+	p.pendingNext++
+	id := p.pendingNext
+
+	p.pending[id] = &pendingRequest{
+		expire:   time.Now().Add(pendingTimeout),
+		response: response,
+	}
+
+	return id
+}
+
+// resolve delivers response to the caller waiting on id, if it is still
+// pending. It reports whether a waiter was found.
+func (p *DNSListener) resolve(id uint32, response []DNSAnswer) bool {
+	p.pendingLock.Lock()
+	req, ok := p.pending[id]
+	if ok {
+		delete(p.pending, id)
+	}
+	p.pendingLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	req.response <- response
+	return true
+}
+
+// abandon removes id from the pending map without delivering a response,
+// used when the caller is already being answered some other way (e.g. a
+// send error).
+func (p *DNSListener) abandon(id uint32) {
+	p.pendingLock.Lock()
+	delete(p.pending, id)
+	p.pendingLock.Unlock()
+}
+
+// Periodic evicts pending requests that outlived pendingTimeout, closing
+// their response channel so a dropped or slow backend response can't leak
+// the goroutine blocked reading from it. It returns when stop is closed.
+func (p *DNSListener) Periodic(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+
+			p.pendingLock.Lock()
+			for id, req := range p.pending {
+				if req.expire.Before(now) {
+					log.Debug("DNS: expiring pending request ", id)
+					close(req.response)
+					delete(p.pending, id)
+				}
+			}
+			p.pendingLock.Unlock()
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// cachedAnswer returns the cached record for key, if any. An entry whose
+// backend-supplied Expire has already passed is treated as a miss — freshness
+// is enforced here, on the read path; cacheJanitor only reclaims memory for
+// entries nobody queries again.
+func (p *DNSListener) cachedAnswer(key dnsCacheKey) (*DNSCacheRecord, bool) {
+	p.DNSCacheLock.RLock()
+	defer p.DNSCacheLock.RUnlock()
+
+	rec, ok := p.DNSCache[key]
+	if !ok || rec.Expire.Before(time.Now()) {
+		return nil, false
+	}
+
+	return rec, true
+}
+
+// storeAnswer caches rec under key.
+func (p *DNSListener) storeAnswer(key dnsCacheKey, rec *DNSCacheRecord) {
+	p.DNSCacheLock.Lock()
+	p.DNSCache[key] = rec
+	p.DNSCacheLock.Unlock()
+}
+
+// cacheJanitor evicts DNS cache records past their backend-supplied Expire,
+// instead of every ServeDNS call sweeping the whole map on the query hot
+// path. It returns when stop is closed.
+func (p *DNSListener) cacheJanitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+
+			p.DNSCacheLock.Lock()
+			for k, v := range p.DNSCache {
+				if v.Expire.Before(now) {
+					log.Debug("Delete cache: ", k)
+					delete(p.DNSCache, k)
+				}
+			}
+			p.DNSCacheLock.Unlock()
+
+		case <-stop:
+			return
+		}
+	}
+}
+
 func (d *Daemon) serveDNS(conn net.Conn, domain string) error {
 	d.DNSListener = NewDNSListener(conn, domain)
 	log.Debug("DNS: Enabled: ", domain)
@@ -38,34 +368,141 @@ func (p *DNSListener) listenAndServeUDP(cherr chan error) {
 	log.Debug("[2.] DNS UDP CLOSED")
 }
 
-func (p *DNSListener) messageReader(cherr chan error, chmsg chan []string) {
+func (p *DNSListener) listenAndServeDoT(cherr chan error) {
+	if p.TLSServer == nil {
+		return
+	}
+
+	err := p.TLSServer.ListenAndServe()
+	if err != nil {
+		log.Error("Couldn't start DoT DNS listener:", err)
+	}
+
+	cherr <- err
+	log.Debug("[4.] DNS DoT CLOSED")
+}
+
+func (p *DNSListener) listenAndServeDoH(cherr chan error) {
+	if p.DoHServer == nil {
+		return
+	}
+
+	err := p.DoHServer.ListenAndServeTLS("", "")
+	if err != nil && err != http.ErrServerClosed {
+		log.Error("Couldn't start DoH DNS listener:", err)
+	}
+
+	cherr <- err
+	log.Debug("[5.] DNS DoH CLOSED")
+}
+
+// dohResponseWriter adapts an http.ResponseWriter so ServeDNS can answer a
+// DoH request the same way it answers UDP/TCP/DoT ones.
+type dohResponseWriter struct {
+	http.ResponseWriter
+	req *http.Request
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, err = w.Write(packed)
+
+	return err
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+func (w *dohResponseWriter) LocalAddr() net.Addr { return &net.TCPAddr{} }
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	host, _, err := net.SplitHostPort(w.req.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	return &net.TCPAddr{IP: net.ParseIP(host)}
+}
+
+// serveDoH decodes an RFC 8484 "application/dns-message" request (either a
+// base64url GET ?dns= parameter or a raw POST body) and dispatches it into
+// ServeDNS, writing the wire-format reply back.
+func (p *DNSListener) serveDoH(w http.ResponseWriter, req *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+
+	switch req.Method {
+	case http.MethodGet:
+		encoded := req.URL.Query().Get("dns")
+		if encoded == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+
+		buf, err = base64.RawURLEncoding.DecodeString(encoded)
+
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		buf, err = io.ReadAll(req.Body)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, "malformed dns message", http.StatusBadRequest)
+		return
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		http.Error(w, "malformed dns message", http.StatusBadRequest)
+		return
+	}
+
+	p.ServeDNS(&dohResponseWriter{ResponseWriter: w, req: req}, m)
+}
+
+func (p *DNSListener) messageReader(cherr chan error) {
 	for {
-		var response []string
+		var (
+			id       uint32
+			response []DNSAnswer
+		)
 
-		err := RecvMessage(p.Conn, &response)
-		if err != nil || response == nil {
+		err := RecvMessage(p.Conn, &id, &response)
+		if err != nil {
 			cherr <- err
 			break
-		} else {
-			chmsg <- response
+		}
+
+		if !p.resolve(id, response) {
+			log.Debug("DNS: response for unknown or expired id ", id)
 		}
 	}
 
 	log.Debug("[3.] REMOTE READER CLOSED")
 }
 
-func (p *DNSListener) messageProcessor(
-	recvStrings chan []string, interrupt <-chan bool, closeNotify chan<- bool, decoderr chan<- error) {
-
+func (p *DNSListener) messageProcessor(interrupt <-chan bool, closeNotify chan<- bool, decoderr chan<- error) {
 	ignore := false
 
 	for {
-		var (
-			err error
-			r   *DNSRequest
-		)
+		var r *DNSRequest
 
-		r = nil
 		interrupted := false
 
 		select {
@@ -84,28 +521,29 @@ func (p *DNSListener) messageProcessor(
 
 		if ignore {
 			if r != nil {
-				r.IPs <- []string{}
+				r.Answers <- []DNSAnswer{}
 				continue
 			} else {
 				break
 			}
 		}
 
-		err = SendMessage(p.Conn, r.Name)
+		// Register before sending so a response racing in ahead of this
+		// call returning still finds a waiter.
+		id := p.register(r.Answers)
+
+		err := SendMessage(p.Conn, id, r.Qtype, r.Name)
 		if err != nil {
-			r.IPs <- []string{}
+			p.abandon(id)
+			r.Answers <- []DNSAnswer{}
 			decoderr <- err
 			ignore = true
 			continue
 		}
 
-		select {
-		case ips := <-recvStrings:
-			r.IPs <- ips
-		case _ = <-interrupt:
-			r.IPs <- []string{}
-			ignore = true
-		}
+		// Don't wait for the matching response here: messageReader
+		// demultiplexes it back to r.Answers by id whenever it arrives,
+		// letting this loop move straight on to the next query.
 	}
 
 	log.Debug("DNS READ/WRITE CLOSED")
@@ -116,104 +554,310 @@ func (p *DNSListener) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	m.SetReply(r)
 	m.Compress = true
 
-	processed := true
+	for _, q := range r.Question {
+		log.Info("DNS: Request: ", q.Name)
 
-	now := time.Now()
+		question := q.Name[:]
+		if q.Name[len(q.Name)-1] == '.' {
+			question = q.Name[:len(q.Name)-1]
+		}
 
-	for k, v := range p.DNSCache {
-		if v.LastActivity.Add(1 * time.Minute).Before(now) {
-			log.Debug("Delete cache: ", k)
-			delete(p.DNSCache, k)
+		if question != p.Domain && !strings.HasSuffix(question, "."+p.Domain) {
+			log.Debug(q.Name, " outside ", p.Domain, ", refusing")
+			m.Rcode = dns.RcodeRefused
+			continue
 		}
-	}
 
-	if len(r.Question) > 0 {
-		for _, q := range r.Question {
-			log.Info("DNS: Request: ", q.Name)
+		if !supportedQtype(q.Qtype) {
+			// Nothing we know how to resolve for this type; answer
+			// NOERROR with an empty answer section and an authority SOA
+			// so the resolver falls back cleanly instead of being told
+			// the name doesn't exist.
+			m.Ns = append(m.Ns, p.soaRecord())
+			continue
+		}
 
-			if _, ok := p.DNSCache[q.Name]; !ok {
-				log.Debug(q.Name, " not in cache")
+		key := dnsCacheKey{Name: q.Name, Qtype: q.Qtype}
 
-				question := q.Name[:]
-				if q.Name[len(q.Name)-1] == '.' {
-					question = q.Name[:len(q.Name)-1]
-				}
+		record, ok := p.cachedAnswer(key)
+		if !ok {
+			log.Debug(q.Name, " not in cache")
+
+			// The zone apex itself (question == p.Domain) has no
+			// subdomain label to strip.
+			subname := ""
+			if question != p.Domain {
+				subname = question[:len(question)-len(p.Domain)-1]
+			}
+
+			result := make(chan []DNSAnswer)
+			p.DNSRequests <- &DNSRequest{
+				Name:    subname,
+				Qtype:   q.Qtype,
+				Answers: result,
+			}
 
-				if strings.HasSuffix(question, p.Domain) {
-					question = question[:len(question)-len(p.Domain)-1]
-
-					result := make(chan []string)
-					p.DNSRequests <- &DNSRequest{
-						Name: question,
-						IPs:  result,
-					}
-
-					responses := <-result
-					log.Info("DNS:", q.Name, responses)
-					defer close(result)
-
-					if len(responses) > 0 {
-						dnsResponses := make([]dns.RR, len(responses))
-
-						for i, response := range responses {
-							a := new(dns.A)
-							a.Hdr = dns.RR_Header{
-								Name:   q.Name,
-								Rrtype: dns.TypeA,
-								Class:  dns.ClassINET,
-								Ttl:    10,
-							}
-							a.A = net.ParseIP(response).To4()
-							dnsResponses[i] = a
-						}
-
-						p.DNSCache[q.Name] = &DNSCacheRecord{
-							ResponseRecords: dnsResponses,
-						}
-					} else {
-						processed = false
-					}
+			answers := <-result
+			log.Info("DNS:", q.Name, answers)
+
+			if len(answers) == 0 {
+				if q.Qtype == dns.TypeA {
+					// The backend protocol has no way to say "name
+					// exists, just not for this type" versus "name
+					// doesn't exist", so only treat an A miss as
+					// authoritative: anything else might just be an
+					// A-only host queried as AAAA/CNAME/etc, which is
+					// NOERROR+SOA, not NXDOMAIN.
+					log.Debug(q.Name, " not found upstream, NXDOMAIN")
+					m.Rcode = dns.RcodeNameError
 				} else {
-					processed = false
+					log.Debug(q.Name, " has no ", dns.TypeToString[q.Qtype], " record upstream")
 				}
+
+				m.Ns = append(m.Ns, p.soaRecord())
+				continue
 			}
 
-			if processed {
-				for _, rr := range p.DNSCache[q.Name].ResponseRecords {
-					m.Answer = append(m.Answer, rr)
+			dnsResponses := make([]dns.RR, 0, len(answers))
+			minTTL := answers[0].TTL
+
+			for _, answer := range answers {
+				if answer.TTL < minTTL {
+					minTTL = answer.TTL
+				}
+
+				rr, err := newRR(q.Name, q.Qtype, answer.Value, answer.TTL)
+				if err != nil {
+					log.Error("DNS: ", err)
+					continue
 				}
 
-				p.DNSCache[q.Name].LastActivity = now
+				dnsResponses = append(dnsResponses, rr)
 			}
+
+			record = &DNSCacheRecord{
+				ResponseRecords: dnsResponses,
+				Expire:          time.Now().Add(time.Duration(minTTL) * time.Second),
+			}
+
+			p.storeAnswer(key, record)
+		}
+
+		ttl := uint32(0)
+		if remaining := time.Until(record.Expire); remaining > 0 {
+			ttl = uint32(remaining / time.Second)
+		}
+
+		for _, rr := range record.ResponseRecords {
+			answer := dns.Copy(rr)
+			answer.Header().Ttl = ttl
+			m.Answer = append(m.Answer, answer)
 		}
 	}
 
 	w.WriteMsg(m)
 }
 
+var (
+	socketActivationOnce sync.Once
+	socketActivationUDP  *os.File
+	socketActivationTCP  *os.File
+)
+
+// socketActivation adopts the UDP and/or TCP sockets systemd passed down via
+// LISTEN_FDS/LISTEN_PID, so the daemon doesn't need CAP_NET_BIND_SERVICE (or
+// root) just to hold :53 itself. It returns nil for either socket this
+// process wasn't handed, which is the common case when run without systemd.
+//
+// NewDNSListener can be constructed more than once per process (e.g. on
+// backend reconnect), and Shutdown() closes whatever conn/listener it was
+// given. So only the fd-adoption decision is cached, as the *os.File backing
+// it, which is never closed and so stays valid for the life of the process;
+// LISTEN_PID/LISTEN_FDS are parsed once, but net.FilePacketConn/FileListener
+// dup the fd internally, so a fresh conn/listener is handed out on every
+// call.
+func socketActivation() (*net.UDPConn, *net.TCPListener) {
+	socketActivationOnce.Do(func() {
+		socketActivationUDP, socketActivationTCP = adoptSocketActivation()
+	})
+
+	var (
+		udpConn     *net.UDPConn
+		tcpListener *net.TCPListener
+	)
+
+	if socketActivationUDP != nil {
+		conn, err := net.FilePacketConn(socketActivationUDP)
+		if err != nil {
+			log.Error("DNS: couldn't re-adopt systemd UDP socket: ", err)
+		} else if c, ok := conn.(*net.UDPConn); ok {
+			udpConn = c
+		}
+	}
+
+	if socketActivationTCP != nil {
+		ln, err := net.FileListener(socketActivationTCP)
+		if err != nil {
+			log.Error("DNS: couldn't re-adopt systemd TCP socket: ", err)
+		} else if l, ok := ln.(*net.TCPListener); ok {
+			tcpListener = l
+		}
+	}
+
+	return udpConn, tcpListener
+}
+
+// adoptSocketActivation does the actual LISTEN_FDS/LISTEN_PID parsing and fd
+// adoption, returning the raw *os.File for each socket type systemd handed
+// down; see socketActivation for why it must only run once per process and
+// why the files it returns must never be closed.
+func adoptSocketActivation() (udpFile, tcpFile *os.File) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < count; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		isUDP, ok := socketIsUDP(fd, i, names)
+		if !ok {
+			log.Error("DNS: couldn't determine socket type of fd ", fd)
+			continue
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+
+		if isUDP {
+			udpFile = file
+		} else {
+			tcpFile = file
+		}
+	}
+
+	return udpFile, tcpFile
+}
+
+// socketIsUDP decides whether fd is a UDP (dgram) or TCP (stream) socket,
+// preferring the name systemd gave it (LISTEN_FDNAMES) and falling back to
+// probing the socket type directly.
+func socketIsUDP(fd, i int, names []string) (isUDP bool, ok bool) {
+	if i < len(names) {
+		switch {
+		case strings.Contains(strings.ToLower(names[i]), "udp"):
+			return true, true
+		case strings.Contains(strings.ToLower(names[i]), "tcp"):
+			return false, true
+		}
+	}
+
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return false, false
+	}
+
+	switch typ {
+	case syscall.SOCK_DGRAM:
+		return true, true
+	case syscall.SOCK_STREAM:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
 func NewDNSListener(conn net.Conn, domain string) *DNSListener {
+	udpConn, tcpListener := socketActivation()
+
 	listener := &DNSListener{
 		Conn:   conn,
 		Domain: domain,
 
-		DNSCache: make(map[string]*DNSCacheRecord),
-		UDPServer: &dns.Server{
+		DNSCache: make(map[dnsCacheKey]*DNSCacheRecord),
+
+		pending:      make(map[uint32]*pendingRequest),
+		stopJanitors: make(chan struct{}),
+
+		SOAMname:   fmt.Sprintf("ns1.%s.", domain),
+		SOARname:   fmt.Sprintf("hostmaster.%s.", domain),
+		SOASerial:  1,
+		SOARefresh: 86400,
+		SOARetry:   7200,
+		SOAExpire:  3600000,
+		SOAMinttl:  10,
+
+		DNSRequests: make(chan *DNSRequest),
+
+		active: true,
+	}
+
+	if udpConn != nil {
+		log.Debug("DNS: adopted systemd UDP socket")
+		listener.UDPServer = &dns.Server{PacketConn: udpConn, Net: "udp", UDPSize: int(UDPSize)}
+	} else {
+		listener.UDPServer = &dns.Server{
 			Addr:    fmt.Sprintf("%s:%d", ExternalBindHost, DnsBindPort),
 			Net:     "udp",
 			UDPSize: int(UDPSize),
-		},
-		TCPServer: &dns.Server{
+		}
+	}
+
+	if tcpListener != nil {
+		log.Debug("DNS: adopted systemd TCP socket")
+		listener.TCPServer = &dns.Server{Listener: tcpListener, Net: "tcp"}
+	} else {
+		listener.TCPServer = &dns.Server{
 			Addr: fmt.Sprintf("%s:%d", ExternalBindHost, DnsBindPort),
 			Net:  "tcp",
-		},
-		DNSRequests: make(chan *DNSRequest),
-
-		active: true,
+		}
 	}
 
 	listener.UDPServer.Handler = listener
 	listener.TCPServer.Handler = listener
 
+	if DoTEnabled {
+		cert, err := tls.LoadX509KeyPair(DoTCertFile, DoTKeyFile)
+		if err != nil {
+			log.Error("DNS: couldn't load DoT certificate, DoT disabled: ", err)
+		} else {
+			listener.TLSServer = &dns.Server{
+				Addr:      fmt.Sprintf("%s:%d", ExternalBindHost, DoTBindPort),
+				Net:       "tcp-tls",
+				TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+			}
+			listener.TLSServer.Handler = listener
+		}
+	}
+
+	if DoHEnabled {
+		cert, err := tls.LoadX509KeyPair(DoHCertFile, DoHKeyFile)
+		if err != nil {
+			log.Error("DNS: couldn't load DoH certificate, DoH disabled: ", err)
+		} else {
+			mux := http.NewServeMux()
+			mux.HandleFunc(DoHPathPrefix, listener.serveDoH)
+
+			listener.DoHServer = &http.Server{
+				Addr:      DoHBindAddr,
+				Handler:   mux,
+				TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+			}
+		}
+	}
+
 	return listener
 }
 
@@ -222,34 +866,42 @@ func (p *DNSListener) Serve() error {
 
 	tcperr := make(chan error)
 	udperr := make(chan error)
+	doterr := make(chan error)
+	doherr := make(chan error)
 	decoderr := make(chan error)
-	recvStrings := make(chan []string)
 	recvErrors := make(chan error)
 	closeNotify := make(chan bool)
 	interruptNotify := make(chan bool)
 
 	defer close(tcperr)
 	defer close(udperr)
+	defer close(doterr)
+	defer close(doherr)
 	defer close(decoderr)
-	defer close(recvStrings)
 	defer close(recvErrors)
 	defer close(closeNotify)
 	defer close(interruptNotify)
 
 	go p.listenAndServeTCP(tcperr)
 	go p.listenAndServeUDP(udperr)
-	go p.messageReader(recvErrors, recvStrings)
-	go p.messageProcessor(recvStrings, interruptNotify, closeNotify, decoderr)
+	go p.listenAndServeDoT(doterr)
+	go p.listenAndServeDoH(doherr)
+	go p.messageReader(recvErrors)
+	go p.messageProcessor(interruptNotify, closeNotify, decoderr)
+	go p.Periodic(pendingSweepInterval, p.stopJanitors)
+	go p.cacheJanitor(cacheSweepInterval, p.stopJanitors)
 
 	var err error
 
 	tcpClosed := false
 	udpClosed := false
+	dotClosed := p.TLSServer == nil
+	dohClosed := p.DoHServer == nil
 	decoderClosed := false
 	msgsClosed := false
 	shutdown := false
 
-	for !(tcpClosed && udpClosed && decoderClosed && msgsClosed) {
+	for !(tcpClosed && udpClosed && dotClosed && dohClosed && decoderClosed && msgsClosed) {
 		var err2 error
 		select {
 		case err2 = <-tcperr:
@@ -258,6 +910,12 @@ func (p *DNSListener) Serve() error {
 		case err2 = <-udperr:
 			udpClosed = true
 
+		case err2 = <-doterr:
+			dotClosed = true
+
+		case err2 = <-doherr:
+			dohClosed = true
+
 		case err2 = <-decoderr:
 			decoderClosed = true
 
@@ -276,18 +934,77 @@ func (p *DNSListener) Serve() error {
 			err = err2
 		}
 
-		log.Debug("CLOSED: ", tcpClosed, udpClosed, decoderClosed, msgsClosed, shutdown)
+		log.Debug("CLOSED: ", tcpClosed, udpClosed, dotClosed, dohClosed, decoderClosed, msgsClosed, shutdown)
 	}
 
 	return err
 }
 
+// SendMessage writes a single outgoing question to the backend connection,
+// tagged with id so multiple in-flight lookups can share one connection and
+// have their responses demultiplexed back to the right caller, and qtype so
+// the backend knows what kind of record to resolve.
+func SendMessage(conn net.Conn, id uint32, qtype uint16, name string) error {
+	buf := make([]byte, 4+2+2+len(name))
+	binary.BigEndian.PutUint32(buf[0:4], id)
+	binary.BigEndian.PutUint16(buf[4:6], qtype)
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(name)))
+	copy(buf[8:], name)
+
+	_, err := conn.Write(buf)
+	return err
+}
+
+// RecvMessage reads one backend response, yielding the transaction id it
+// answers and the answers (value plus the TTL the backend wants it served
+// and cached with) it carries.
+func RecvMessage(conn net.Conn, id *uint32, response *[]DNSAnswer) error {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	*id = binary.BigEndian.Uint32(header[0:4])
+	count := binary.BigEndian.Uint16(header[4:6])
+
+	answers := make([]DNSAnswer, count)
+
+	for i := range answers {
+		rechdr := make([]byte, 4+2)
+		if _, err := io.ReadFull(conn, rechdr); err != nil {
+			return err
+		}
+
+		ttl := binary.BigEndian.Uint32(rechdr[0:4])
+
+		strbuf := make([]byte, binary.BigEndian.Uint16(rechdr[4:6]))
+		if _, err := io.ReadFull(conn, strbuf); err != nil {
+			return err
+		}
+
+		answers[i] = DNSAnswer{Value: string(strbuf), TTL: ttl}
+	}
+
+	*response = answers
+	return nil
+}
+
 func (p *DNSListener) Shutdown() {
 	p.activeLock.Lock()
 	if p.active {
 		p.UDPServer.Shutdown()
 		p.TCPServer.Shutdown()
+
+		if p.TLSServer != nil {
+			p.TLSServer.Shutdown()
+		}
+
+		if p.DoHServer != nil {
+			p.DoHServer.Shutdown(context.Background())
+		}
+
 		close(p.DNSRequests)
+		close(p.stopJanitors)
 		p.Conn.Close()
 		p.active = false
 	}
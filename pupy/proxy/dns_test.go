@@ -0,0 +1,210 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	dns "github.com/miekg/dns"
+)
+
+func TestNewRR(t *testing.T) {
+	cases := []struct {
+		name    string
+		qtype   uint16
+		value   string
+		wantErr bool
+	}{
+		{"A valid", dns.TypeA, "192.0.2.1", false},
+		{"A invalid", dns.TypeA, "not-an-ip", true},
+		{"A rejects IPv6", dns.TypeA, "2001:db8::1", true},
+		{"AAAA valid", dns.TypeAAAA, "2001:db8::1", false},
+		{"AAAA invalid", dns.TypeAAAA, "not-an-ip", true},
+		{"CNAME valid", dns.TypeCNAME, "target.example.com", false},
+		{"TXT valid", dns.TypeTXT, "hello world", false},
+		{"SRV valid", dns.TypeSRV, "10 20 443 target.example.com", false},
+		{"SRV malformed", dns.TypeSRV, "not a srv value", true},
+		{"unsupported qtype", dns.TypeMX, "10 mail.example.com", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr, err := newRR("host.example.com", tc.qtype, tc.value, 60)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("newRR(%q, %q): expected error, got %v", dns.TypeToString[tc.qtype], tc.value, rr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("newRR(%q, %q): unexpected error: %v", dns.TypeToString[tc.qtype], tc.value, err)
+			}
+
+			if rr.Header().Rrtype != tc.qtype {
+				t.Fatalf("newRR: got Rrtype %d, want %d", rr.Header().Rrtype, tc.qtype)
+			}
+		})
+	}
+}
+
+func TestSplitTXT(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{"empty", "", []string{""}},
+		{"short", "hello", []string{"hello"}},
+		{"exactly one chunk", string(make([]byte, 255)), []string{string(make([]byte, 255))}},
+		{"spans two chunks", string(make([]byte, 300)), []string{string(make([]byte, 255)), string(make([]byte, 45))}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := splitTXT(tc.value)
+			if len(got) != len(tc.want) {
+				t.Fatalf("splitTXT(%d bytes): got %d chunks, want %d", len(tc.value), len(got), len(tc.want))
+			}
+
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("splitTXT(%d bytes): chunk %d has length %d, want %d", len(tc.value), i, len(got[i]), len(tc.want[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestSOARecord(t *testing.T) {
+	p := &DNSListener{
+		Domain:     "example.com",
+		SOAMname:   "ns1.example.com",
+		SOARname:   "hostmaster.example.com",
+		SOASerial:  1,
+		SOARefresh: 2,
+		SOARetry:   3,
+		SOAExpire:  4,
+		SOAMinttl:  5,
+	}
+
+	soa := p.soaRecord()
+
+	if soa.Hdr.Name != "example.com." {
+		t.Errorf("soaRecord: Hdr.Name = %q, want %q", soa.Hdr.Name, "example.com.")
+	}
+
+	if soa.Ns != "ns1.example.com." {
+		t.Errorf("soaRecord: Ns = %q, want %q", soa.Ns, "ns1.example.com.")
+	}
+
+	if soa.Mbox != "hostmaster.example.com." {
+		t.Errorf("soaRecord: Mbox = %q, want %q", soa.Mbox, "hostmaster.example.com.")
+	}
+
+	if soa.Hdr.Ttl != p.SOAMinttl {
+		t.Errorf("soaRecord: Hdr.Ttl = %d, want %d (Minttl)", soa.Hdr.Ttl, p.SOAMinttl)
+	}
+}
+
+func newTestDNSListener() *DNSListener {
+	return &DNSListener{
+		DNSCache: make(map[dnsCacheKey]*DNSCacheRecord),
+		pending:  make(map[uint32]*pendingRequest),
+	}
+}
+
+func TestCachedAnswerExpiresOnRead(t *testing.T) {
+	p := newTestDNSListener()
+	key := dnsCacheKey{Name: "host.example.com", Qtype: dns.TypeA}
+
+	p.storeAnswer(key, &DNSCacheRecord{Expire: time.Now().Add(time.Hour)})
+	if _, ok := p.cachedAnswer(key); !ok {
+		t.Fatal("cachedAnswer: fresh entry reported as a miss")
+	}
+
+	p.storeAnswer(key, &DNSCacheRecord{Expire: time.Now().Add(-time.Second)})
+	if _, ok := p.cachedAnswer(key); ok {
+		t.Fatal("cachedAnswer: expired entry served instead of treated as a miss")
+	}
+
+	if _, ok := p.cachedAnswer(dnsCacheKey{Name: "missing.example.com", Qtype: dns.TypeA}); ok {
+		t.Fatal("cachedAnswer: uncached key reported as a hit")
+	}
+}
+
+func TestRegisterResolveAbandon(t *testing.T) {
+	p := newTestDNSListener()
+
+	response := make(chan []DNSAnswer, 1)
+	id := p.register(response)
+
+	answers := []DNSAnswer{{Value: "192.0.2.1", TTL: 60}}
+	if !p.resolve(id, answers) {
+		t.Fatal("resolve: expected pending request to be found")
+	}
+
+	select {
+	case got := <-response:
+		if len(got) != 1 || got[0].Value != "192.0.2.1" {
+			t.Fatalf("resolve: delivered %v, want %v", got, answers)
+		}
+	default:
+		t.Fatal("resolve: reported success but nothing was delivered to response")
+	}
+
+	if p.resolve(id, answers) {
+		t.Fatal("resolve: same id resolved twice")
+	}
+
+	id2 := p.register(make(chan []DNSAnswer, 1))
+	p.abandon(id2)
+	if p.resolve(id2, answers) {
+		t.Fatal("resolve: abandoned id should no longer be pending")
+	}
+}
+
+func TestSocketIsUDPFromName(t *testing.T) {
+	cases := []struct {
+		name    string
+		names   []string
+		i       int
+		wantUDP bool
+		wantOK  bool
+	}{
+		{"udp name", []string{"dns-udp"}, 0, true, true},
+		{"tcp name", []string{"dns-tcp"}, 0, false, true},
+		{"UDP uppercase", []string{"DNS-UDP"}, 0, true, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			isUDP, ok := socketIsUDP(-1, tc.i, tc.names)
+			if ok != tc.wantOK || isUDP != tc.wantUDP {
+				t.Fatalf("socketIsUDP(%v, %d) = (%v, %v), want (%v, %v)", tc.names, tc.i, isUDP, ok, tc.wantUDP, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestSocketIsUDPFromSockType(t *testing.T) {
+	udpFD, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("socket(SOCK_DGRAM): %v", err)
+	}
+	defer syscall.Close(udpFD)
+
+	if isUDP, ok := socketIsUDP(udpFD, 0, nil); !ok || !isUDP {
+		t.Errorf("socketIsUDP(udp fd) = (%v, %v), want (true, true)", isUDP, ok)
+	}
+
+	tcpFD, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socket(SOCK_STREAM): %v", err)
+	}
+	defer syscall.Close(tcpFD)
+
+	if isUDP, ok := socketIsUDP(tcpFD, 0, nil); !ok || isUDP {
+		t.Errorf("socketIsUDP(tcp fd) = (%v, %v), want (false, true)", isUDP, ok)
+	}
+}